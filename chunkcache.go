@@ -0,0 +1,179 @@
+package dxfs2
+
+import (
+	"container/list"
+	"encoding/json"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+)
+
+// chunkCacheChunkSize is the granularity at which downloaded byte ranges
+// are memoized in the shared cache. It intentionally matches
+// prefetchChunkSize so that a prefetched chunk and a cached chunk are the
+// same object.
+const chunkCacheChunkSize = prefetchChunkSize
+
+// chunkKey identifies one fixed-size range of one dx file.
+type chunkKey struct {
+	fileId   string
+	chunkIdx int64
+}
+
+// chunkCacheMetrics are exposed read-only via the admin socket.
+type chunkCacheMetrics struct {
+	Hits      uint64 `json:"hits"`
+	Misses    uint64 `json:"misses"`
+	Coalesced uint64 `json:"coalesced"`
+	Evictions uint64 `json:"evictions"`
+	UsedBytes int64  `json:"used_bytes"`
+	CapBytes  int64  `json:"capacity_bytes"`
+}
+
+// inflightFetch lets concurrent callers asking for the same chunk share a
+// single outstanding HTTP GET, instead of each issuing their own.
+type inflightFetch struct {
+	done chan struct{}
+	data []byte
+	err  error
+}
+
+// ChunkCache is a process-wide, size-bounded LRU of downloaded byte
+// ranges, shared by every FileHandle opened against this FS. It coalesces
+// concurrent requests for the same chunk into a single network fetch.
+type ChunkCache struct {
+	capBytes int64
+
+	mu       sync.Mutex
+	used     int64
+	ll       *list.List // front = most recently used
+	items    map[chunkKey]*list.Element
+	inflight map[chunkKey]*inflightFetch
+
+	hits      uint64
+	misses    uint64
+	coalesced uint64
+	evictions uint64
+}
+
+type chunkCacheEntry struct {
+	key  chunkKey
+	data []byte
+}
+
+// NewChunkCache creates a shared chunk cache with the given byte budget.
+// A non-positive capacity disables caching: every fetch goes straight
+// through, though in-flight coalescing still applies.
+func NewChunkCache(capBytes int64) *ChunkCache {
+	return &ChunkCache{
+		capBytes: capBytes,
+		ll:       list.New(),
+		items:    make(map[chunkKey]*list.Element),
+		inflight: make(map[chunkKey]*inflightFetch),
+	}
+}
+
+// Get returns the bytes for (fileId, chunkIdx), calling fetch at most once
+// even if many goroutines ask for the same chunk concurrently.
+func (c *ChunkCache) Get(fileId string, chunkIdx int64, fetch func() ([]byte, error)) ([]byte, error) {
+	key := chunkKey{fileId: fileId, chunkIdx: chunkIdx}
+
+	c.mu.Lock()
+	if el, ok := c.items[key]; ok {
+		c.ll.MoveToFront(el)
+		atomic.AddUint64(&c.hits, 1)
+		data := el.Value.(*chunkCacheEntry).data
+		c.mu.Unlock()
+		return data, nil
+	}
+	if f, ok := c.inflight[key]; ok {
+		atomic.AddUint64(&c.coalesced, 1)
+		c.mu.Unlock()
+		<-f.done
+		return f.data, f.err
+	}
+
+	f := &inflightFetch{done: make(chan struct{})}
+	c.inflight[key] = f
+	atomic.AddUint64(&c.misses, 1)
+	c.mu.Unlock()
+
+	data, err := fetch()
+	f.data, f.err = data, err
+	close(f.done)
+
+	c.mu.Lock()
+	delete(c.inflight, key)
+	if err == nil {
+		c.insertLocked(key, data)
+	}
+	c.mu.Unlock()
+
+	return data, err
+}
+
+// insertLocked adds a chunk to the LRU, evicting the least recently used
+// entries until the cache is back under budget. Callers must hold c.mu.
+func (c *ChunkCache) insertLocked(key chunkKey, data []byte) {
+	if c.capBytes <= 0 {
+		return
+	}
+	el := c.ll.PushFront(&chunkCacheEntry{key: key, data: data})
+	c.items[key] = el
+	c.used += int64(len(data))
+
+	for c.used > c.capBytes {
+		back := c.ll.Back()
+		if back == nil {
+			break
+		}
+		c.ll.Remove(back)
+		evicted := back.Value.(*chunkCacheEntry)
+		delete(c.items, evicted.key)
+		c.used -= int64(len(evicted.data))
+		c.evictions++
+	}
+}
+
+func (c *ChunkCache) metrics() chunkCacheMetrics {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return chunkCacheMetrics{
+		Hits:      atomic.LoadUint64(&c.hits),
+		Misses:    atomic.LoadUint64(&c.misses),
+		Coalesced: atomic.LoadUint64(&c.coalesced),
+		Evictions: c.evictions,
+		UsedBytes: c.used,
+		CapBytes:  c.capBytes,
+	}
+}
+
+// serveAdmin listens on a Unix domain socket and answers every connection
+// with a JSON dump of the cache metrics. It is meant for operators running
+// `nc -U $sock` or a small script, not a long-lived protocol.
+func (c *ChunkCache) serveAdmin(socketPath string) error {
+	if socketPath == "" {
+		return nil
+	}
+	os.Remove(socketPath)
+	l, err := net.Listen("unix", socketPath)
+	if err != nil {
+		return err
+	}
+	go func() {
+		defer l.Close()
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				enc := json.NewEncoder(conn)
+				enc.Encode(c.metrics())
+			}()
+		}
+	}()
+	return nil
+}
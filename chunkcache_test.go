@@ -0,0 +1,70 @@
+package dxfs2
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestChunkCacheCoalescesConcurrentFetches(t *testing.T) {
+	c := NewChunkCache(1 << 20)
+
+	var calls int32
+	start := make(chan struct{})
+	fetch := func() ([]byte, error) {
+		atomic.AddInt32(&calls, 1)
+		<-start
+		return []byte("chunk-data"), nil
+	}
+
+	const callers = 8
+	results := make([][]byte, callers)
+	var wg sync.WaitGroup
+	wg.Add(callers)
+	for i := 0; i < callers; i++ {
+		go func(i int) {
+			defer wg.Done()
+			data, err := c.Get("file-xxxx", 0, fetch)
+			if err != nil {
+				t.Errorf("Get returned error: %v", err)
+			}
+			results[i] = data
+		}(i)
+	}
+
+	// hold the fetch open until every other caller has joined it, so that
+	// none of them arrives after it finished and is served from the cache.
+	deadline := time.Now().Add(5 * time.Second)
+	for atomic.LoadUint64(&c.coalesced) < callers-1 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	close(start)
+	wg.Wait()
+
+	if got := atomic.LoadInt32(&calls); got != 1 {
+		t.Fatalf("fetch called %d times, want exactly 1", got)
+	}
+	for i, data := range results {
+		if string(data) != "chunk-data" {
+			t.Errorf("result[%d] = %q, want %q", i, data, "chunk-data")
+		}
+	}
+
+	m := c.metrics()
+	if m.Misses != 1 {
+		t.Errorf("Misses = %d, want 1", m.Misses)
+	}
+	if m.Coalesced != callers-1 {
+		t.Errorf("Coalesced = %d, want %d", m.Coalesced, callers-1)
+	}
+
+	// a later call for the same chunk should now hit the cache rather than
+	// fetching or coalescing again.
+	if _, err := c.Get("file-xxxx", 0, fetch); err != nil {
+		t.Fatalf("Get returned error on cache hit: %v", err)
+	}
+	if got := atomic.LoadInt32(&calls); got != 1 {
+		t.Fatalf("fetch called %d times after cache hit, want 1", got)
+	}
+}
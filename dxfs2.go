@@ -3,11 +3,10 @@ package dxfs2
 import (
 	"encoding/json"
 	"fmt"
-	"log"
 	"os"
 	"os/user"
-	"sort"
 	"strconv"
+	"sync"
 	"syscall"
 	"time"
 
@@ -20,26 +19,58 @@ import (
 	"golang.org/x/net/context"
 )
 
+// PathFilter restricts the subtree of a project that is exposed under the
+// mountpoint. An empty Folders list means "the whole project".
+type PathFilter struct {
+	ProjectId string
+	Folders   []string
+}
+
+// FS is the root of the mounted filesystem. Unlike the original flat-file
+// layout, the catalog is not pre-populated: directories are discovered lazily
+// by calling the dx /listFolder API and the results are cached for a short
+// TTL, so the mount scales to projects with arbitrarily large folder trees.
 type FS struct {
 	// configuration information for accessing dnanexus servers
 	dxEnv dxda.DXEnvironment
 
-	// File catalog. A fixed list of dx:files that are exposed by this mount point.
-	catalog map[string]DxFileDesc
+	// top level projects exposed by this mount point, and the subset of
+	// each project's folders that should be visible (nil means "all").
+	projects    []string
+	pathFilters map[string][]PathFilter
+
+	// lazily populated, TTL-bounded cache of folder listings, keyed by the
+	// project-qualified folder path (e.g. "/project-xxxx/a/b").
+	dCache *dirCache
+
+	// mode is ReadOnly unless the mount was opted into ReadWrite; spillDir
+	// holds staged writes until they are uploaded and the dx file closed.
+	mode     Mode
+	spillDir string
+
+	// chunkCache memoizes downloaded byte ranges across every handle and
+	// every file, so two readers of the same file (or the same reader
+	// re-reading a range) share one HTTP GET per chunk.
+	chunkCache *ChunkCache
 
 	uid uint32
 	gid uint32
 }
 
 type Dir struct {
-	fs    *FS
-	path   string
+	fs   *FS
+	path string
 }
 
 type File struct {
-	fs       *FS
-	dxDesc   *DxDescribe
-	inode     uint64
+	fs     *FS
+	dxDesc *DxDescribe
+	inode  uint64
+
+	// lazily-fetched tags/properties/details, cached for metaTTL
+	metaMu      sync.Mutex
+	meta        *dxFileMeta
+	metaExpires time.Time
 }
 
 // A URL generated with the /file-xxxx/download API call, that is
@@ -54,22 +85,36 @@ type FileHandle struct {
 
 	// URL used for downloading file ranges
 	url DxDownloadURL
-}
 
-type DxFileDesc struct {
-	dxDesc DxDescribe
-	inode uint64
+	// detects sequential access and prefetches ahead of the reader
+	pf *prefetcher
+
+	// non-nil only for a handle opened by Dir.Create in ReadWrite mode
+	ws *writeState
 }
 
-const BASE_FILE_INODE uint64 = 10
+// dirListTTL is how long a folder listing is trusted before it is
+// re-fetched from the platform.
+const dirListTTL = 60 * time.Second
 
 // Mount the filesystem:
 //  - setup the debug log to the FUSE kernel log (I think)
-//  - mount as read-only
-func Mount(mountpoint string, dxEnv dxda.DXEnvironment, files map[string]DxDescribe) error {
-	//log.Printf("mounting dxfs2\n")
-	c, err := fuse.Mount(mountpoint, fuse.AllowOther(), fuse.ReadOnly(),
-		fuse.MaxReadahead(1024 * 1024), fuse.AsyncRead())
+//  - mount read-only unless mode is ReadWrite
+//
+// projects is the list of dx project-ids to expose at the mount root, each
+// as a top-level directory. filters, if non-nil, restricts the folders
+// visible under a given project; a project with no entry is shown in full.
+// spillDir is where staged writes are buffered in ReadWrite mode; it is
+// ignored in ReadOnly mode and defaults to os.TempDir() if empty.
+// chunkCacheBytes bounds the shared, process-wide chunk cache; adminSocket,
+// if non-empty, is a Unix socket that answers connections with a JSON dump
+// of the cache's hit/miss/coalesce counters.
+func Mount(mountpoint string, dxEnv dxda.DXEnvironment, projects []string, filters map[string][]PathFilter, mode Mode, spillDir string, chunkCacheBytes int64, adminSocket string) error {
+	mountOpts := []fuse.MountOption{fuse.AllowOther(), fuse.MaxReadahead(1024 * 1024), fuse.AsyncRead()}
+	if mode == ReadOnly {
+		mountOpts = append(mountOpts, fuse.ReadOnly())
+	}
+	c, err := fuse.Mount(mountpoint, mountOpts...)
 	if err != nil {
 		return err
 	}
@@ -89,24 +134,19 @@ func Mount(mountpoint string, dxEnv dxda.DXEnvironment, files map[string]DxDescr
 		return err
 	}
 
-	// set a mapping from file-id to its description.
-	// Choose a stable inode for each file. It cannot change
-	// during the filesystem lifetime.
-	var inodeCnt uint64 = BASE_FILE_INODE
-	catalog := make(map[string]DxFileDesc)
-	for fid, dxDesc := range(files) {
-		catalog[fid] = DxFileDesc {
-			dxDesc : dxDesc,
-			inode : inodeCnt,
-		}
-		inodeCnt++
-	}
-
 	filesys := &FS{
-		dxEnv : dxEnv,
-		catalog : catalog,
-		uid : uint32(uid),
-		gid : uint32(gid),
+		dxEnv:       dxEnv,
+		projects:    projects,
+		pathFilters: filters,
+		dCache:      newDirCache(dirListTTL),
+		mode:        mode,
+		spillDir:    spillDir,
+		chunkCache:  NewChunkCache(chunkCacheBytes),
+		uid:         uint32(uid),
+		gid:         uint32(gid),
+	}
+	if err := filesys.chunkCache.serveAdmin(adminSocket); err != nil {
+		return err
 	}
 	if err := fs.Serve(c, filesys); err != nil {
 		return err
@@ -124,10 +164,9 @@ func Mount(mountpoint string, dxEnv dxda.DXEnvironment, files map[string]DxDescr
 var _ fs.FS = (*FS)(nil)
 
 func (f *FS) Root() (fs.Node, error) {
-	//log.Printf("Get root directory\n")
 	n := &Dir{
-		fs : f,
-		path : "/",
+		fs:   f,
+		path: "/",
 	}
 	return n, nil
 }
@@ -135,16 +174,17 @@ func (f *FS) Root() (fs.Node, error) {
 // Make sure that Dir implements the fs.Node interface
 var _ fs.Node = (*Dir)(nil)
 
-
-// We only support the root directory
+// Attr works for any depth of directory: the root, a project, or a folder
+// inside a project. Directories have no dx-native metadata of their own, so
+// the attributes are synthetic; only the inode is meaningful, and it must
+// stay the same across mounts so that the kernel's dentry cache can be
+// trusted.
 func (dir *Dir) Attr(ctx context.Context, a *fuse.Attr) error {
-	if dir.path != "/" {
-		return fuse.ENOSYS;
-	}
-	// this can be retained in cache indefinitely (a year is an approximation)
-	a.Valid = time.Until(time.Unix(1000 * 1000 * 1000, 0))
-	a.Inode = 1
-	a.Size = 4096  // dummy size
+	a.Inode = inodeForPath(dir.path)
+	// folder listings can be stale for up to the TTL, so let the kernel
+	// hold on to the attributes for the same amount of time.
+	a.Valid = dirListTTL
+	a.Size = 4096 // dummy size
 	a.Blocks = 8
 	a.Atime = time.Now()
 	a.Mtime = time.Now()
@@ -152,66 +192,70 @@ func (dir *Dir) Attr(ctx context.Context, a *fuse.Attr) error {
 	a.Mode = os.ModeDir | 0777
 	a.Nlink = 1
 	a.Uid = dir.fs.uid
-	a.Gid = dir.fs.uid
+	a.Gid = dir.fs.gid
 	a.BlockSize = 4 * 1024
 	return nil
 }
 
+var _ = fs.HandleReadDirAller(&Dir{})
+
 func (dir *Dir) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
-	//log.Printf("ReadDirAll dir=%s\n", dir.path)
-
-	// create a directory entry for each of the file descriptions
-	dEntries := make([]fuse.Dirent, 0, len(dir.fs.catalog))
-	for key, fDesc := range dir.fs.catalog {
-		dEntries = append(dEntries, fuse.Dirent{
-			Inode : fDesc.inode,
-			Type : fuse.DT_File,
-			Name : key,
-		})
+	if dir.path == "/" {
+		return dir.fs.readRootDir(), nil
 	}
-	sort.Slice(dEntries, func(i, j int) bool { return dEntries[i].Name < dEntries[j].Name })
-	return dEntries, nil
-}
 
-var _ = fs.HandleReadDirAller(&Dir{})
+	listing, err := dir.fs.getFolderListing(ctx, dir.path)
+	if err != nil {
+		return nil, err
+	}
+	return listing.dirents(), nil
+}
 
 var _ = fs.NodeRequestLookuper(&Dir{})
 
-// We ignore the directory, because it is always the root of the filesystem.
 func (dir *Dir) Lookup(ctx context.Context, req *fuse.LookupRequest, resp *fuse.LookupResponse) (fs.Node, error) {
-	//log.Printf("Lookup dir=%s  filename=%s\n", dir.path, req.Name)
+	if dir.path == "/" {
+		return dir.fs.lookupProject(req.Name)
+	}
 
-	// lookup in the in-memory catalog
-	catEntry, ok := dir.fs.catalog[req.Name]
-	if !ok {
-		// file does not exist
-		return nil, fuse.ENOENT
+	listing, err := dir.fs.getFolderListing(ctx, dir.path)
+	if err != nil {
+		return nil, err
 	}
 
-	child := &File{
-		fs: dir.fs,
-		dxDesc: &catEntry.dxDesc,
-		inode: catEntry.inode,
+	childPath := joinFolderPath(dir.path, req.Name)
+	if _, isDir := listing.subdirs[req.Name]; isDir {
+		return &Dir{fs: dir.fs, path: childPath}, nil
+	}
+	if desc, isFile := listing.files[req.Name]; isFile {
+		return &File{
+			fs:     dir.fs,
+			dxDesc: desc,
+			inode:  inodeForDxId(desc.FileId),
+		}, nil
 	}
-	return child, nil
+	return nil, fuse.ENOENT
 }
 
 var _ fs.Node = (*File)(nil)
 
 func (f *File) Attr(ctx context.Context, a *fuse.Attr) error {
+	a.Inode = f.inode
 	a.Size = f.dxDesc.Size
-	//log.Printf("Attr  size=%d\n", a.Size)
 
 	// because the platform has only immutable files, these
 	// timestamps are all the same
-	a.Mtime = f.dxDesc.Mtime
+	a.Mtime = f.dxDesc.Ctime
 	a.Ctime = f.dxDesc.Ctime
 	a.Crtime = f.dxDesc.Ctime
-	a.Mode = 0400 // read only access
+	if f.fs.mode == ReadWrite {
+		a.Mode = 0600
+	} else {
+		a.Mode = 0400
+	}
 	a.Nlink = 1
 	a.Uid = f.fs.uid
 	a.Gid = f.fs.gid
-	//a.BlockSize = 1024 * 1024
 	return nil
 }
 
@@ -228,7 +272,7 @@ func (f *File) Open(ctx context.Context, req *fuse.OpenRequest, resp *fuse.OpenR
 	payload := fmt.Sprintf("{\"project\": \"%s\", \"duration\": %d}",
 		f.dxDesc.ProjId, secondsInYear)
 
-	body, err := DxAPI(&f.fs.dxEnv, fmt.Sprintf("%s/download", f.dxDesc.FileId), payload)
+	body, err := DxAPI(ctx, &f.fs.dxEnv, fmt.Sprintf("%s/download", f.dxDesc.FileId), payload)
 	if err != nil {
 		return nil, err
 	}
@@ -236,9 +280,10 @@ func (f *File) Open(ctx context.Context, req *fuse.OpenRequest, resp *fuse.OpenR
 	json.Unmarshal(body, &u)
 
 	fh := &FileHandle{
-		f : f,
+		f:   f,
 		url: u,
 	}
+	fh.pf = newPrefetcher(fh, f.dxDesc.Size)
 	return fh, nil
 }
 
@@ -247,31 +292,41 @@ var _ fs.Handle = (*FileHandle)(nil)
 var _ fs.HandleReleaser = (*FileHandle)(nil)
 
 func (fh *FileHandle) Release(ctx context.Context, req *fuse.ReleaseRequest) error {
-	// nothing to do
-	return nil
+	fh.pf.close()
+
+	// The kernel normally calls Flush before Release, but that is not
+	// guaranteed (e.g. the process holding the fd was killed). Finalize
+	// defensively so a write-mode handle is never torn down with its dx
+	// object still open and unflushed.
+	var err error
+	if fh.ws != nil {
+		err = fh.Flush(ctx, &fuse.FlushRequest{})
+	}
+	fh.cleanupSpill()
+	return err
 }
 
 var _ = fs.HandleReader(&FileHandle{})
 
+// Read is served out of the per-handle prefetch cache. On a cache miss it
+// falls back to a direct, synchronous range GET so correctness never
+// depends on the read-ahead heuristic kicking in.
 func (fh *FileHandle) Read(ctx context.Context, req *fuse.ReadRequest, resp *fuse.ReadResponse) error {
-	headers := make(map[string]string)
+	return fh.pf.read(ctx, req, resp)
+}
 
-	// Copy the immutable headers
+// fetchRange performs a single ranged GET against the file's download URL,
+// used both for cache-miss reads and for prefetch fills. ctx ties the
+// request to whichever FUSE op (or background prefetch) triggered it, so
+// a kernel-interrupted read actually aborts the transfer.
+func (fh *FileHandle) fetchRange(ctx context.Context, offset, size int64) ([]byte, error) {
+	headers := make(map[string]string)
 	for key, value := range fh.url.Headers {
 		headers[key] = value
 	}
-
-	// add an extent in the file that we want to read
-	endOfs := req.Offset + int64(req.Size) - 1
-	headers["Range"] = fmt.Sprintf("bytes=%d-%d", req.Offset, endOfs)
-	//log.Printf("Read  ofs=%d  len=%d\n", req.Offset, req.Size)
+	endOfs := offset + size - 1
+	headers["Range"] = fmt.Sprintf("bytes=%d-%d", offset, endOfs)
 
 	reqUrl := fh.url.URL + "/" + fh.f.dxDesc.ProjId
-	body,err := DxHttpRequest("GET", reqUrl, headers, []byte("{}"))
-	if err != nil {
-		return err
-	}
-
-	resp.Data = body
-	return nil
+	return DxHttpRequest(ctx, "GET", reqUrl, headers, []byte("{}"))
 }
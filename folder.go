@@ -0,0 +1,226 @@
+package dxfs2
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"bazil.org/fuse"
+
+	"golang.org/x/net/context"
+)
+
+// folderListing is the cached, parsed result of a single /listFolder call:
+// the subfolders and data objects directly inside one dx folder. path is
+// the project-qualified path of the folder this listing is for, needed to
+// derive the same inode for a subdirectory here as Dir.Attr/Lookup compute
+// when that subdirectory is visited directly.
+type folderListing struct {
+	path    string
+	subdirs map[string]bool
+	files   map[string]*DxDescribe
+	expires time.Time
+}
+
+func (l *folderListing) dirents() []fuse.Dirent {
+	dEntries := make([]fuse.Dirent, 0, len(l.subdirs)+len(l.files))
+	for name := range l.subdirs {
+		dEntries = append(dEntries, fuse.Dirent{
+			Inode: inodeForPath(joinFolderPath(l.path, name)),
+			Type:  fuse.DT_Dir,
+			Name:  name,
+		})
+	}
+	for name, desc := range l.files {
+		dEntries = append(dEntries, fuse.Dirent{
+			Inode: inodeForDxId(desc.FileId),
+			Type:  fuse.DT_File,
+			Name:  name,
+		})
+	}
+	return dEntries
+}
+
+// dirCache memoizes folder listings for a bounded amount of time, so that a
+// `ls -R` style walk does not re-issue a /listFolder API call for every
+// Attr/Lookup/ReadDirAll on the same directory.
+type dirCache struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	entries map[string]*folderListing
+}
+
+func newDirCache(ttl time.Duration) *dirCache {
+	return &dirCache{
+		ttl:     ttl,
+		entries: make(map[string]*folderListing),
+	}
+}
+
+func (c *dirCache) get(folder string) (*folderListing, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	l, ok := c.entries[folder]
+	if !ok || time.Now().After(l.expires) {
+		return nil, false
+	}
+	return l, true
+}
+
+func (c *dirCache) put(folder string, l *folderListing) {
+	l.expires = time.Now().Add(c.ttl)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries[folder] = l
+}
+
+// invalidate drops a cached listing, forcing the next lookup to re-fetch
+// it. Used after a write-mode operation (create/remove/rename) changes a
+// folder's contents.
+func (c *dirCache) invalidate(folder string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.entries, folder)
+}
+
+// joinFolderPath appends a path element to a project-qualified folder path.
+func joinFolderPath(folder, name string) string {
+	return path.Join(folder, name)
+}
+
+// splitProjectFolder splits a project-qualified path such as
+// "/project-xxxx/a/b" into the project-id and the in-project folder
+// ("/a/b").
+func splitProjectFolder(p string) (projId string, folder string) {
+	trimmed := strings.TrimPrefix(p, "/")
+	parts := strings.SplitN(trimmed, "/", 2)
+	projId = parts[0]
+	if len(parts) == 1 {
+		return projId, "/"
+	}
+	return projId, "/" + parts[1]
+}
+
+// inodeForPath derives a stable inode number from a project-qualified
+// directory path. Because it is a pure function of the path, the same
+// directory gets the same inode across process restarts.
+func inodeForPath(p string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte("dir:"))
+	h.Write([]byte(p))
+	return h.Sum64()
+}
+
+// inodeForDxId derives a stable inode number from a dx object id (e.g.
+// "file-xxxx"), so that the same file always maps to the same inode.
+func inodeForDxId(dxid string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte("obj:"))
+	h.Write([]byte(dxid))
+	return h.Sum64()
+}
+
+// readRootDir lists the projects configured at mount time as the top-level
+// directories of the filesystem.
+func (f *FS) readRootDir() []fuse.Dirent {
+	dEntries := make([]fuse.Dirent, 0, len(f.projects))
+	for _, projId := range f.projects {
+		dEntries = append(dEntries, fuse.Dirent{
+			Inode: inodeForPath("/" + projId),
+			Type:  fuse.DT_Dir,
+			Name:  projId,
+		})
+	}
+	return dEntries
+}
+
+func (f *FS) lookupProject(name string) (*Dir, error) {
+	for _, projId := range f.projects {
+		if projId == name {
+			return &Dir{fs: f, path: "/" + projId}, nil
+		}
+	}
+	return nil, fuse.ENOENT
+}
+
+// allowedFolder reports whether a folder inside a project is within the
+// path filters configured for it, or is an ancestor of such a folder. No
+// filters for the project means everything is visible.
+func (f *FS) allowedFolder(projId, folder string) bool {
+	filters, ok := f.pathFilters[projId]
+	if !ok || len(filters) == 0 {
+		return true
+	}
+	for _, pf := range filters {
+		if pf.ProjectId != projId {
+			continue
+		}
+		if len(pf.Folders) == 0 {
+			return true
+		}
+		for _, allowed := range pf.Folders {
+			if folder == allowed || strings.HasPrefix(folder, strings.TrimSuffix(allowed, "/")+"/") {
+				return true
+			}
+			// an ancestor of an allowed folder must stay visible, or the
+			// allowed folder itself could never be reached.
+			if strings.HasPrefix(allowed, strings.TrimSuffix(folder, "/")+"/") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// dxListFolderResponse is the body of a /project-xxxx/listFolder response.
+type dxListFolderResponse struct {
+	Folders []string `json:"folders"`
+	Objects []struct {
+		Describe DxDescribe `json:"describe"`
+	} `json:"objects"`
+}
+
+// getFolderListing returns the (possibly cached) contents of a
+// project-qualified folder path, issuing a /listFolder API call on a cache
+// miss or expiry.
+func (f *FS) getFolderListing(ctx context.Context, dirPath string) (*folderListing, error) {
+	if l, ok := f.dCache.get(dirPath); ok {
+		return l, nil
+	}
+
+	projId, folder := splitProjectFolder(dirPath)
+	payload := fmt.Sprintf(`{"folder": %q, "only": "all", "describe": {"fields": {"size": true, "modified": true, "created": true}}}`, folder)
+	body, err := DxAPI(ctx, &f.dxEnv, fmt.Sprintf("%s/listFolder", projId), payload)
+	if err != nil {
+		return nil, err
+	}
+
+	var r dxListFolderResponse
+	if err := json.Unmarshal(body, &r); err != nil {
+		return nil, err
+	}
+
+	l := &folderListing{
+		path:    dirPath,
+		subdirs: make(map[string]bool),
+		files:   make(map[string]*DxDescribe),
+	}
+	for _, sub := range r.Folders {
+		name := path.Base(sub)
+		if !f.allowedFolder(projId, sub) {
+			continue
+		}
+		l.subdirs[name] = true
+	}
+	for i := range r.Objects {
+		desc := r.Objects[i].Describe
+		l.files[desc.Name] = &desc
+	}
+
+	f.dCache.put(dirPath, l)
+	return l, nil
+}
@@ -0,0 +1,22 @@
+package dxfs2
+
+import "testing"
+
+func TestSplitProjectFolder(t *testing.T) {
+	cases := []struct {
+		in         string
+		wantProj   string
+		wantFolder string
+	}{
+		{"/project-xxxx", "project-xxxx", "/"},
+		{"/project-xxxx/a", "project-xxxx", "/a"},
+		{"/project-xxxx/a/b", "project-xxxx", "/a/b"},
+	}
+	for _, c := range cases {
+		projId, folder := splitProjectFolder(c.in)
+		if projId != c.wantProj || folder != c.wantFolder {
+			t.Errorf("splitProjectFolder(%q) = (%q, %q), want (%q, %q)",
+				c.in, projId, folder, c.wantProj, c.wantFolder)
+		}
+	}
+}
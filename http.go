@@ -0,0 +1,155 @@
+package dxfs2
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"time"
+
+	"github.com/dnanexus/dxda"
+
+	"golang.org/x/net/context"
+)
+
+// retryPolicy controls how DxHttpRequest/DxAPI respond to transient
+// failures: 5xx responses, connection resets, and (for DxHttpRequest)
+// bodies shorter than the requested Range.
+type retryPolicy struct {
+	MaxRetries     int
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+}
+
+var defaultRetryPolicy = retryPolicy{
+	MaxRetries:     5,
+	InitialBackoff: 200 * time.Millisecond,
+	MaxBackoff:     10 * time.Second,
+}
+
+// noRetryPolicy is used for calls that are not safe to retry blind: a 5xx
+// (or connection reset) gives no guarantee the request didn't already take
+// effect on the platform, so retrying a non-idempotent mutation (creating a
+// file, adding a tag, moving/renaming an object) risks performing it twice.
+var noRetryPolicy = retryPolicy{MaxRetries: 0}
+
+// backoff returns the delay before retry attempt n (0-based), with full
+// jitter so that a fleet of handles retrying at once does not stampede.
+func (p retryPolicy) backoff(attempt int) time.Duration {
+	d := p.InitialBackoff << uint(attempt)
+	if d > p.MaxBackoff || d <= 0 {
+		d = p.MaxBackoff
+	}
+	return time.Duration(rand.Int63n(int64(d) + 1))
+}
+
+func isRetryableStatus(code int) bool {
+	return code >= 500 && code < 600
+}
+
+// DxHttpRequest issues an HTTP request against the dx platform (or a
+// pre-signed download/upload URL). ctx is threaded onto the request so a
+// FUSE op cancelled by the kernel actually aborts the in-flight transfer
+// instead of blocking a worker until it completes on its own. Transient
+// failures are retried with exponential backoff: this is only safe to call
+// directly for idempotent requests (range GETs, upload-part PUTs to a
+// dx-issued URL keyed by part index). Non-idempotent mutations must go
+// through dxHttpRequestWithPolicy with noRetryPolicy instead.
+func DxHttpRequest(ctx context.Context, method, url string, headers map[string]string, body []byte) ([]byte, error) {
+	return dxHttpRequestWithPolicy(ctx, defaultRetryPolicy, method, url, headers, body)
+}
+
+func dxHttpRequestWithPolicy(ctx context.Context, policy retryPolicy, method, url string, headers map[string]string, body []byte) ([]byte, error) {
+	var lastErr error
+	for attempt := 0; attempt <= policy.MaxRetries; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-time.After(policy.backoff(attempt - 1)):
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+		}
+
+		req, err := http.NewRequest(method, url, bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		req = req.WithContext(ctx)
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			lastErr = err
+			continue
+		}
+
+		respBody, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			lastErr = err
+			continue
+		}
+
+		if isRetryableStatus(resp.StatusCode) {
+			lastErr = fmt.Errorf("dx http request to %s failed with status %d", url, resp.StatusCode)
+			continue
+		}
+		if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+			return nil, fmt.Errorf("dx http request to %s failed with status %d: %s", url, resp.StatusCode, string(respBody))
+		}
+
+		if rangeHeader, wantRange := headers["Range"]; wantRange {
+			if wantLen, ok := rangeLen(rangeHeader); ok && int64(len(respBody)) < wantLen {
+				// a short body on a range request corrupts what the
+				// kernel sees if left alone; retry rather than return it.
+				lastErr = fmt.Errorf("short read from %s: got %d of %d bytes", url, len(respBody), wantLen)
+				continue
+			}
+		}
+
+		return respBody, nil
+	}
+	return nil, lastErr
+}
+
+// rangeLen parses a "bytes=A-B" Range header and returns B-A+1.
+func rangeLen(rangeHeader string) (int64, bool) {
+	var lo, hi int64
+	if _, err := fmt.Sscanf(rangeHeader, "bytes=%d-%d", &lo, &hi); err != nil {
+		return 0, false
+	}
+	return hi - lo + 1, true
+}
+
+// DxAPI calls a dx platform API method (e.g. "file-xxxx/describe") with a
+// JSON payload, authenticating with dxEnv. ctx cancels the underlying HTTP
+// request. Transient failures are retried, so this must only be used for
+// idempotent methods: read-only ones such as describe/listFolder, and a
+// file's upload (keyed by part index) and close; any other mutation
+// belongs in DxAPIMutate instead.
+func DxAPI(ctx context.Context, dxEnv *dxda.DXEnvironment, apiMethod string, payload string) ([]byte, error) {
+	return dxAPIWithPolicy(ctx, defaultRetryPolicy, dxEnv, apiMethod, payload)
+}
+
+// DxAPIMutate calls a dx platform API method that is not safe to retry
+// blind: file/new, addTags/removeTags, setProperties/setDetails,
+// move/rename, removeObjects. On a 5xx or connection failure it returns the
+// error immediately rather than risk performing the mutation twice.
+func DxAPIMutate(ctx context.Context, dxEnv *dxda.DXEnvironment, apiMethod string, payload string) ([]byte, error) {
+	return dxAPIWithPolicy(ctx, noRetryPolicy, dxEnv, apiMethod, payload)
+}
+
+func dxAPIWithPolicy(ctx context.Context, policy retryPolicy, dxEnv *dxda.DXEnvironment, apiMethod string, payload string) ([]byte, error) {
+	url := fmt.Sprintf("%s/%s", dxEnv.ApiServer, apiMethod)
+	headers := map[string]string{
+		"Content-Type":  "application/json",
+		"Authorization": fmt.Sprintf("Bearer %s", dxEnv.Token),
+	}
+	return dxHttpRequestWithPolicy(ctx, policy, "POST", url, headers, []byte(payload))
+}
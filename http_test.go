@@ -0,0 +1,24 @@
+package dxfs2
+
+import "testing"
+
+func TestRangeLen(t *testing.T) {
+	cases := []struct {
+		header  string
+		wantLen int64
+		wantOk  bool
+	}{
+		{"bytes=0-0", 1, true},
+		{"bytes=0-1023", 1024, true},
+		{"bytes=1024-2047", 1024, true},
+		{"not a range", 0, false},
+		{"", 0, false},
+	}
+	for _, c := range cases {
+		gotLen, gotOk := rangeLen(c.header)
+		if gotOk != c.wantOk || (gotOk && gotLen != c.wantLen) {
+			t.Errorf("rangeLen(%q) = (%d, %v), want (%d, %v)",
+				c.header, gotLen, gotOk, c.wantLen, c.wantOk)
+		}
+	}
+}
@@ -0,0 +1,209 @@
+package dxfs2
+
+import (
+	"sync"
+
+	"bazil.org/fuse"
+
+	"golang.org/x/net/context"
+)
+
+const (
+	// prefetchChunkSize is the size of each range GET issued once
+	// sequential access has been detected.
+	prefetchChunkSize int64 = 8 * 1024 * 1024
+
+	// prefetchRingLen bounds how many chunks are held in memory at once,
+	// per open file handle.
+	prefetchRingLen = 4
+
+	// sequentialThreshold is the number of consecutive, contiguous reads
+	// required before read-ahead kicks in. A single random read fetches only
+	// the chunk(s) it falls in, not the prefetchRingLen chunks after them.
+	sequentialThreshold = 2
+)
+
+// chunk is one fetched (or in-flight) extent of the file, aligned to
+// prefetchChunkSize.
+type chunk struct {
+	index int64 // offset / prefetchChunkSize
+	ready chan struct{}
+	data  []byte
+	err   error
+}
+
+func (c *chunk) offset() int64 { return c.index * prefetchChunkSize }
+
+// prefetcher serves FileHandle.Read out of a bounded ring of chunks,
+// firing asynchronous read-ahead GETs once it detects sequential access on
+// the handle.
+type prefetcher struct {
+	fh       *FileHandle
+	fileSize int64
+
+	mu         sync.Mutex
+	ring       map[int64]*chunk // chunk index -> chunk
+	order      []int64          // insertion order, for eviction
+	lastOffset int64
+	lastSize   int64
+	sequential int
+	closed     bool
+}
+
+func newPrefetcher(fh *FileHandle, fileSize int64) *prefetcher {
+	return &prefetcher{
+		fh:         fh,
+		fileSize:   fileSize,
+		ring:       make(map[int64]*chunk),
+		lastOffset: -1,
+	}
+}
+
+func (p *prefetcher) close() {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	p.closed = true
+	p.mu.Unlock()
+}
+
+// read answers a FUSE read, which may span two adjacent chunks, by copying
+// directly out of the cache into a preallocated slab. It blocks only when
+// the needed chunk(s) are not yet resident.
+func (p *prefetcher) read(ctx context.Context, req *fuse.ReadRequest, resp *fuse.ReadResponse) error {
+	size := int64(req.Size)
+	if req.Offset >= p.fileSize {
+		resp.Data = resp.Data[:0]
+		return nil
+	}
+	if req.Offset+size > p.fileSize {
+		size = p.fileSize - req.Offset
+	}
+
+	p.noteAccess(req.Offset, size)
+
+	firstIdx := req.Offset / prefetchChunkSize
+	lastIdx := (req.Offset + size - 1) / prefetchChunkSize
+
+	slab := make([]byte, size)
+	for idx := firstIdx; idx <= lastIdx; idx++ {
+		c, err := p.fetch(ctx, idx)
+		if err != nil {
+			return err
+		}
+		chunkStart := c.offset()
+		// intersect [req.Offset, req.Offset+size) with [chunkStart, chunkStart+len(c.data))
+		lo := req.Offset
+		if chunkStart > lo {
+			lo = chunkStart
+		}
+		hi := req.Offset + size
+		if chunkStart+int64(len(c.data)) < hi {
+			hi = chunkStart + int64(len(c.data))
+		}
+		if lo >= hi {
+			continue
+		}
+		copy(slab[lo-req.Offset:hi-req.Offset], c.data[lo-chunkStart:hi-chunkStart])
+	}
+
+	resp.Data = slab
+	p.maybeReadAhead(lastIdx)
+	return nil
+}
+
+// noteAccess tracks whether successive reads on this handle are
+// contiguous, which is the trigger for read-ahead. A read only counts as
+// sequential if it starts exactly where the previous one ended; a
+// monotonically increasing but sparse access pattern (e.g. scanning a
+// sorted index at scattered offsets) must not trip read-ahead.
+func (p *prefetcher) noteAccess(offset, size int64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.lastOffset >= 0 && offset == p.lastOffset+p.lastSize {
+		p.sequential++
+	} else {
+		p.sequential = 0
+	}
+	p.lastOffset = offset
+	p.lastSize = size
+}
+
+// fetch returns the chunk at idx, fetching it synchronously if it is not
+// already resident or in flight.
+func (p *prefetcher) fetch(ctx context.Context, idx int64) (*chunk, error) {
+	p.mu.Lock()
+	if c, ok := p.ring[idx]; ok {
+		p.mu.Unlock()
+		<-c.ready
+		return c, c.err
+	}
+	c := &chunk{index: idx, ready: make(chan struct{})}
+	p.insert(idx, c)
+	p.mu.Unlock()
+
+	p.fill(c)
+	return c, c.err
+}
+
+// fill resolves a chunk's bytes through the FS-wide chunk cache, so that
+// concurrent handles on the same file share one download per chunk. The
+// fetch itself always runs on a background context, never the context of
+// whichever caller happens to win the cache's singleflight race: that
+// fetch's result is shared with every other handle waiting on the same
+// chunk, so it must not be torn down just because one particular waiter's
+// FUSE request was cancelled while the others are still live.
+func (p *prefetcher) fill(c *chunk) {
+	offset := c.offset()
+	size := prefetchChunkSize
+	if offset+size > p.fileSize {
+		size = p.fileSize - offset
+	}
+	c.data, c.err = p.fh.f.fs.chunkCache.Get(p.fh.f.dxDesc.FileId, c.index, func() ([]byte, error) {
+		return p.fh.fetchRange(context.Background(), offset, size)
+	})
+	close(c.ready)
+}
+
+// maybeReadAhead fires asynchronous fetches for the next chunks once
+// enough consecutive reads have shown this handle is being read
+// sequentially.
+func (p *prefetcher) maybeReadAhead(lastIdx int64) {
+	p.mu.Lock()
+	sequential := p.sequential
+	closed := p.closed
+	p.mu.Unlock()
+	if closed || sequential < sequentialThreshold {
+		return
+	}
+
+	for i := int64(1); i <= prefetchRingLen; i++ {
+		idx := lastIdx + i
+		if idx*prefetchChunkSize >= p.fileSize {
+			break
+		}
+		p.mu.Lock()
+		_, exists := p.ring[idx]
+		if !exists && !p.closed {
+			c := &chunk{index: idx, ready: make(chan struct{})}
+			p.insert(idx, c)
+			p.mu.Unlock()
+			go p.fill(c)
+		} else {
+			p.mu.Unlock()
+		}
+	}
+}
+
+// insert adds a chunk to the ring, evicting the oldest entry once the ring
+// is full. Callers must hold p.mu.
+func (p *prefetcher) insert(idx int64, c *chunk) {
+	p.ring[idx] = c
+	p.order = append(p.order, idx)
+	if len(p.order) > prefetchRingLen {
+		oldest := p.order[0]
+		p.order = p.order[1:]
+		delete(p.ring, oldest)
+	}
+}
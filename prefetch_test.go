@@ -0,0 +1,30 @@
+package dxfs2
+
+import "testing"
+
+func TestNoteAccessSequential(t *testing.T) {
+	p := newPrefetcher(nil, 1<<30)
+
+	// first read never counts as sequential, whatever its offset.
+	p.noteAccess(0, 100)
+	if p.sequential != 0 {
+		t.Fatalf("after first read, sequential = %d, want 0", p.sequential)
+	}
+
+	// a read starting exactly where the previous one ended is sequential.
+	p.noteAccess(100, 100)
+	if p.sequential != 1 {
+		t.Fatalf("after contiguous read, sequential = %d, want 1", p.sequential)
+	}
+	p.noteAccess(200, 100)
+	if p.sequential != 2 {
+		t.Fatalf("after two contiguous reads, sequential = %d, want 2", p.sequential)
+	}
+
+	// a monotonically increasing but sparse read resets the streak: it must
+	// not be mistaken for sequential access.
+	p.noteAccess(1000, 100)
+	if p.sequential != 0 {
+		t.Fatalf("after sparse read, sequential = %d, want 0", p.sequential)
+	}
+}
@@ -0,0 +1,358 @@
+package dxfs2
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"syscall"
+
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+
+	"golang.org/x/net/context"
+)
+
+// Mode selects whether the mount allows file creation/modification. The
+// dx platform only has immutable, closed files, so ReadWrite is staged
+// locally and only becomes visible on the platform once a file is closed.
+type Mode int
+
+const (
+	ReadOnly Mode = iota
+	ReadWrite
+)
+
+// uploadPartSize is the size of each part uploaded to the dx multipart
+// upload API. It must match what /file-xxxx/upload expects per part.
+const uploadPartSize int64 = 16 * 1024 * 1024
+
+// writeState tracks an in-progress, not-yet-closed dx file: the local
+// spill file that buffers writes (which may arrive out of order) and the
+// dx-side upload bookkeeping.
+type writeState struct {
+	mu sync.Mutex
+
+	projId    string
+	dirPath   string // project-qualified folder the file was created in
+	fileId    string // allocated once, via /file/new
+	spillPath string
+	spill     *os.File
+	size      int64 // highest offset+len written so far
+	dirty     bool
+	closed    bool // true once /file-xxxx/close has succeeded
+}
+
+var _ = fs.NodeCreater(&Dir{})
+
+// Create allocates a new, empty dx file and a local spill file to stage
+// writes into. The dx file is not visible to other readers until Flush/
+// Release uploads and closes it.
+func (dir *Dir) Create(ctx context.Context, req *fuse.CreateRequest, resp *fuse.CreateResponse) (fs.Node, fs.Handle, error) {
+	if dir.fs.mode != ReadWrite {
+		return nil, nil, fuse.Errno(syscall.EROFS)
+	}
+	if dir.path == "/" {
+		// the root only contains projects, which are not dx objects a file
+		// can be created alongside.
+		return nil, nil, fuse.Errno(syscall.EPERM)
+	}
+
+	listing, err := dir.fs.getFolderListing(ctx, dir.path)
+	if err == nil {
+		if existing, ok := listing.files[req.Name]; ok && existing.FileId != "" {
+			// dx files are immutable once closed; this mount does not
+			// support truncating and replacing one in place.
+			return nil, nil, fuse.Errno(syscall.EPERM)
+		}
+	}
+
+	projId, folder := splitProjectFolder(dir.path)
+	payload := fmt.Sprintf(`{"project": %q, "name": %q, "folder": %q, "parents": true}`,
+		projId, req.Name, folder)
+	body, err := DxAPIMutate(ctx, &dir.fs.dxEnv, "file/new", payload)
+	if err != nil {
+		return nil, nil, err
+	}
+	var fn struct {
+		Id string `json:"id"`
+	}
+	if err := json.Unmarshal(body, &fn); err != nil {
+		return nil, nil, err
+	}
+
+	spillFile, spillPath, err := dir.fs.newSpillFile()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	dxDesc := &DxDescribe{
+		FileId: fn.Id,
+		ProjId: projId,
+		Name:   req.Name,
+	}
+	f := &File{
+		fs:     dir.fs,
+		dxDesc: dxDesc,
+		inode:  inodeForDxId(fn.Id),
+	}
+	fh := &FileHandle{
+		f: f,
+		ws: &writeState{
+			projId:    projId,
+			dirPath:   dir.path,
+			fileId:    fn.Id,
+			spillPath: spillPath,
+			spill:     spillFile,
+		},
+	}
+	dir.fs.dCache.invalidate(dir.path)
+	return f, fh, nil
+}
+
+// newSpillFile creates a private temp file used to stage out-of-order
+// writes before they are uploaded as dx multipart upload parts.
+func (f *FS) newSpillFile() (*os.File, string, error) {
+	spillDir := f.spillDir
+	if spillDir == "" {
+		spillDir = os.TempDir()
+	}
+	fh, err := ioutil.TempFile(spillDir, "dxfuse-spill-")
+	if err != nil {
+		return nil, "", err
+	}
+	return fh, fh.Name(), nil
+}
+
+var _ = fs.HandleWriter(&FileHandle{})
+
+// Write buffers into the local spill file. Offsets may arrive out of
+// order (the kernel does not guarantee sequential writeback), so this is
+// a plain pwrite into the spill file rather than an append.
+func (fh *FileHandle) Write(ctx context.Context, req *fuse.WriteRequest, resp *fuse.WriteResponse) error {
+	if fh.ws == nil {
+		return fuse.Errno(syscall.EROFS)
+	}
+	ws := fh.ws
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+
+	if ws.closed {
+		return fuse.Errno(syscall.EPERM)
+	}
+	n, err := ws.spill.WriteAt(req.Data, req.Offset)
+	if err != nil {
+		return err
+	}
+	if end := req.Offset + int64(n); end > ws.size {
+		ws.size = end
+	}
+	ws.dirty = true
+	resp.Size = n
+	return nil
+}
+
+var _ = fs.HandleFlusher(&FileHandle{})
+
+// Flush uploads the spill file's contents to dx as multipart upload parts
+// and closes the file, making it visible to other readers. It is a no-op
+// for read-only handles, but it still runs (uploading one empty part) for a
+// handle that was created and released without ever being written to
+// (e.g. `touch`) — Create already allocated the dx object via /file/new,
+// and that object must still be closed or it is left open forever.
+func (fh *FileHandle) Flush(ctx context.Context, req *fuse.FlushRequest) error {
+	ws := fh.ws
+	if ws == nil {
+		return nil
+	}
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	if ws.closed {
+		return nil
+	}
+
+	if err := fh.uploadPartsLocked(ctx); err != nil {
+		return err
+	}
+
+	closePayload := "{}"
+	if _, err := DxAPI(ctx, &fh.f.fs.dxEnv, fmt.Sprintf("%s/close", ws.fileId), closePayload); err != nil {
+		return err
+	}
+	ws.closed = true
+	ws.dirty = false
+	fh.f.dxDesc.Size = ws.size
+	fh.f.fs.dCache.invalidate(ws.dirPath)
+	return nil
+}
+
+// uploadPartsLocked splits the spill file into fixed-size parts and
+// uploads them in parallel via /file-xxxx/upload. Callers must hold
+// ws.mu.
+func (fh *FileHandle) uploadPartsLocked(ctx context.Context) error {
+	ws := fh.ws
+	numParts := int((ws.size + uploadPartSize - 1) / uploadPartSize)
+	if numParts == 0 {
+		numParts = 1 // dx requires at least one (possibly empty) part
+	}
+
+	errs := make(chan error, numParts)
+	var wg sync.WaitGroup
+	for i := 0; i < numParts; i++ {
+		wg.Add(1)
+		go func(partIndex int) {
+			defer wg.Done()
+			errs <- fh.uploadPart(ctx, partIndex)
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// uploadPart uploads the partIndex'th (1-based on the wire) chunk of the
+// spill file, retrying is left to DxHttpRequest's own policy.
+func (fh *FileHandle) uploadPart(ctx context.Context, partIndex int) error {
+	ws := fh.ws
+	offset := int64(partIndex) * uploadPartSize
+	size := uploadPartSize
+	if offset+size > ws.size {
+		size = ws.size - offset
+	}
+	buf := make([]byte, size)
+	if _, err := ws.spill.ReadAt(buf, offset); err != nil {
+		return err
+	}
+
+	payload := fmt.Sprintf(`{"index": %d}`, partIndex+1)
+	body, err := DxAPI(ctx, &fh.f.fs.dxEnv, fmt.Sprintf("%s/upload", ws.fileId), payload)
+	if err != nil {
+		return err
+	}
+	var u DxDownloadURL
+	if err := json.Unmarshal(body, &u); err != nil {
+		return err
+	}
+
+	headers := make(map[string]string)
+	for k, v := range u.Headers {
+		headers[k] = v
+	}
+	_, err = DxHttpRequest(ctx, "PUT", u.URL, headers, buf)
+	return err
+}
+
+// cleanupSpill closes the local spill file once the kernel is done with
+// the handle. It only deletes the spill file from disk once its contents
+// are known to have been uploaded and the dx object closed; if Flush was
+// never called (or failed) the spill file is left in place so the staged
+// writes and the still-open dx object are not silently lost.
+func (fh *FileHandle) cleanupSpill() {
+	ws := fh.ws
+	if ws == nil {
+		return
+	}
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	ws.spill.Close()
+	if ws.closed {
+		os.Remove(ws.spillPath)
+	}
+}
+
+var _ = fs.NodeRemover(&Dir{})
+
+// Remove deletes a file from its containing project folder. dx has no
+// notion of unlinking a directory entry independent of deleting the
+// object, so this removes the underlying dx object outright.
+func (dir *Dir) Remove(ctx context.Context, req *fuse.RemoveRequest) error {
+	if dir.fs.mode != ReadWrite {
+		return fuse.Errno(syscall.EROFS)
+	}
+	if dir.path == "/" {
+		// the root only contains projects, which this mount does not
+		// support removing.
+		return fuse.Errno(syscall.EPERM)
+	}
+	if req.Dir {
+		// folder removal is not supported yet.
+		return fuse.Errno(syscall.ENOTEMPTY)
+	}
+
+	listing, err := dir.fs.getFolderListing(ctx, dir.path)
+	if err != nil {
+		return err
+	}
+	desc, ok := listing.files[req.Name]
+	if !ok {
+		return fuse.ENOENT
+	}
+
+	projId, _ := splitProjectFolder(dir.path)
+	payload := fmt.Sprintf(`{"objects": [%q]}`, desc.FileId)
+	if _, err := DxAPIMutate(ctx, &dir.fs.dxEnv, fmt.Sprintf("%s/removeObjects", projId), payload); err != nil {
+		return err
+	}
+	dir.fs.dCache.invalidate(dir.path)
+	return nil
+}
+
+var _ = fs.NodeRenamer(&Dir{})
+
+// Rename moves/renames a dx file using the platform's rename + move APIs.
+// Renaming across projects is not supported.
+func (dir *Dir) Rename(ctx context.Context, req *fuse.RenameRequest, newDir fs.Node) error {
+	if dir.fs.mode != ReadWrite {
+		return fuse.Errno(syscall.EROFS)
+	}
+	if dir.path == "/" {
+		// the root only contains projects, which are not renameable dx
+		// objects.
+		return fuse.Errno(syscall.EPERM)
+	}
+	newDirNode, ok := newDir.(*Dir)
+	if !ok {
+		return fuse.Errno(syscall.EXDEV)
+	}
+	if newDirNode.path == "/" {
+		return fuse.Errno(syscall.EPERM)
+	}
+
+	listing, err := dir.fs.getFolderListing(ctx, dir.path)
+	if err != nil {
+		return err
+	}
+	desc, ok := listing.files[req.OldName]
+	if !ok {
+		return fuse.ENOENT
+	}
+
+	srcProj, srcFolder := splitProjectFolder(dir.path)
+	dstProj, dstFolder := splitProjectFolder(newDirNode.path)
+	if srcProj != dstProj {
+		return fuse.Errno(syscall.EXDEV)
+	}
+
+	if dstFolder != srcFolder {
+		payload := fmt.Sprintf(`{"objects": [%q], "destination": %q}`, desc.FileId, dstFolder)
+		if _, err := DxAPIMutate(ctx, &dir.fs.dxEnv, fmt.Sprintf("%s/move", srcProj), payload); err != nil {
+			return err
+		}
+	}
+	if req.NewName != req.OldName {
+		payload := fmt.Sprintf(`{"project": %q, "name": %q}`, srcProj, req.NewName)
+		if _, err := DxAPIMutate(ctx, &dir.fs.dxEnv, fmt.Sprintf("%s/rename", desc.FileId), payload); err != nil {
+			return err
+		}
+	}
+
+	dir.fs.dCache.invalidate(dir.path)
+	dir.fs.dCache.invalidate(newDirNode.path)
+	return nil
+}
@@ -0,0 +1,197 @@
+package dxfs2
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"syscall"
+	"time"
+
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+
+	"golang.org/x/net/context"
+)
+
+// xattr namespace prefixes. Standard Linux tooling (getfattr/setfattr,
+// rsync -X) only passes through the "user." namespace to unprivileged
+// processes, so dx-native metadata is exposed under user.dnanexus.*.
+const (
+	xattrTagPrefix      = "user.dnanexus.tag."
+	xattrPropertyPrefix = "user.dnanexus.property."
+	xattrDetails        = "user.dnanexus.details"
+)
+
+// metaTTL bounds how long a file's tags/properties/details are trusted
+// before Getxattr/Listxattr re-fetches them.
+const metaTTL = 60 * time.Second
+
+// dxFileMeta is the subset of a /file-xxxx/describe response this mount
+// cares about for xattr purposes.
+type dxFileMeta struct {
+	Tags       []string          `json:"tags"`
+	Properties map[string]string `json:"properties"`
+	Details    json.RawMessage   `json:"details"`
+}
+
+// getMeta returns the file's tags/properties/details, describing it on a
+// cache miss or expiry.
+func (f *File) getMeta(ctx context.Context) (*dxFileMeta, error) {
+	f.metaMu.Lock()
+	defer f.metaMu.Unlock()
+	if f.meta != nil && time.Now().Before(f.metaExpires) {
+		return f.meta, nil
+	}
+
+	payload := `{"fields": {"tags": true, "properties": true, "details": true}}`
+	body, err := DxAPI(ctx, &f.fs.dxEnv, fmt.Sprintf("%s/describe", f.dxDesc.FileId), payload)
+	if err != nil {
+		return nil, err
+	}
+	var m dxFileMeta
+	if err := json.Unmarshal(body, &m); err != nil {
+		return nil, err
+	}
+	f.meta = &m
+	f.metaExpires = time.Now().Add(metaTTL)
+	return f.meta, nil
+}
+
+// invalidateMeta forces the next Getxattr/Listxattr to re-describe the
+// file, used right after a Setxattr/Removexattr changes it.
+func (f *File) invalidateMeta() {
+	f.metaMu.Lock()
+	f.meta = nil
+	f.metaMu.Unlock()
+}
+
+var _ = fs.NodeGetxattrer(&File{})
+
+func (f *File) Getxattr(ctx context.Context, req *fuse.GetxattrRequest, resp *fuse.GetxattrResponse) error {
+	meta, err := f.getMeta(ctx)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case req.Name == xattrDetails:
+		if len(meta.Details) == 0 {
+			return fuse.Errno(syscall.ENODATA)
+		}
+		resp.Xattr = []byte(meta.Details)
+		return nil
+
+	case strings.HasPrefix(req.Name, xattrTagPrefix):
+		tag := strings.TrimPrefix(req.Name, xattrTagPrefix)
+		for _, t := range meta.Tags {
+			if t == tag {
+				resp.Xattr = []byte{}
+				return nil
+			}
+		}
+		return fuse.Errno(syscall.ENODATA)
+
+	case strings.HasPrefix(req.Name, xattrPropertyPrefix):
+		key := strings.TrimPrefix(req.Name, xattrPropertyPrefix)
+		if val, ok := meta.Properties[key]; ok {
+			resp.Xattr = []byte(val)
+			return nil
+		}
+		return fuse.Errno(syscall.ENODATA)
+	}
+
+	return fuse.Errno(syscall.ENODATA)
+}
+
+var _ = fs.NodeListxattrer(&File{})
+
+func (f *File) Listxattr(ctx context.Context, req *fuse.ListxattrRequest, resp *fuse.ListxattrResponse) error {
+	meta, err := f.getMeta(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, t := range meta.Tags {
+		resp.Append(xattrTagPrefix + t)
+	}
+	for k := range meta.Properties {
+		resp.Append(xattrPropertyPrefix + k)
+	}
+	if len(meta.Details) > 0 {
+		resp.Append(xattrDetails)
+	}
+	return nil
+}
+
+var _ = fs.NodeSetxattrer(&File{})
+
+// Setxattr writes through to the platform immediately; there is no local
+// staging of metadata the way there is for file content.
+func (f *File) Setxattr(ctx context.Context, req *fuse.SetxattrRequest) error {
+	if f.fs.mode != ReadWrite {
+		return fuse.Errno(syscall.EROFS)
+	}
+
+	switch {
+	case req.Name == xattrDetails:
+		if !json.Valid(req.Xattr) {
+			return fuse.Errno(syscall.EINVAL)
+		}
+		payload := fmt.Sprintf(`{"details": %s}`, req.Xattr)
+		if _, err := DxAPIMutate(ctx, &f.fs.dxEnv, fmt.Sprintf("%s/setDetails", f.dxDesc.FileId), payload); err != nil {
+			return err
+		}
+
+	case strings.HasPrefix(req.Name, xattrTagPrefix):
+		tag := strings.TrimPrefix(req.Name, xattrTagPrefix)
+		payload := fmt.Sprintf(`{"tags": [%q]}`, tag)
+		if _, err := DxAPIMutate(ctx, &f.fs.dxEnv, fmt.Sprintf("%s/addTags", f.dxDesc.FileId), payload); err != nil {
+			return err
+		}
+
+	case strings.HasPrefix(req.Name, xattrPropertyPrefix):
+		key := strings.TrimPrefix(req.Name, xattrPropertyPrefix)
+		payload := fmt.Sprintf(`{"properties": {%q: %q}}`, key, string(req.Xattr))
+		if _, err := DxAPIMutate(ctx, &f.fs.dxEnv, fmt.Sprintf("%s/setProperties", f.dxDesc.FileId), payload); err != nil {
+			return err
+		}
+
+	default:
+		return fuse.Errno(syscall.ENOTSUP)
+	}
+
+	f.invalidateMeta()
+	return nil
+}
+
+var _ = fs.NodeRemovexattrer(&File{})
+
+// Removexattr un-tags or clears a property. dx has no API to remove the
+// details blob, so that case is rejected.
+func (f *File) Removexattr(ctx context.Context, req *fuse.RemovexattrRequest) error {
+	if f.fs.mode != ReadWrite {
+		return fuse.Errno(syscall.EROFS)
+	}
+
+	switch {
+	case strings.HasPrefix(req.Name, xattrTagPrefix):
+		tag := strings.TrimPrefix(req.Name, xattrTagPrefix)
+		payload := fmt.Sprintf(`{"tags": [%q]}`, tag)
+		if _, err := DxAPIMutate(ctx, &f.fs.dxEnv, fmt.Sprintf("%s/removeTags", f.dxDesc.FileId), payload); err != nil {
+			return err
+		}
+
+	case strings.HasPrefix(req.Name, xattrPropertyPrefix):
+		key := strings.TrimPrefix(req.Name, xattrPropertyPrefix)
+		payload := fmt.Sprintf(`{"properties": {%q: null}}`, key)
+		if _, err := DxAPIMutate(ctx, &f.fs.dxEnv, fmt.Sprintf("%s/setProperties", f.dxDesc.FileId), payload); err != nil {
+			return err
+		}
+
+	default:
+		return fuse.Errno(syscall.EPERM)
+	}
+
+	f.invalidateMeta()
+	return nil
+}